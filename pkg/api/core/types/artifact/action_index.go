@@ -0,0 +1,124 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// indexNamespace salts the key IndexEntry records are stored under, so it
+// never collides with an OutputID (a hash of file content) that happens to
+// equal some ActionID's hash.
+const indexNamespace = "luet-cache-action:"
+
+// IndexEntry is the small record Put persists under an ActionID, pointing
+// at the content-addressed OutputID the actual bytes are stored under, the
+// way Go's build cache separates its ActionID index from its OutputID blob
+// store.
+type IndexEntry struct {
+	OutputID OutputID
+	Size     int64
+	Time     time.Time
+}
+
+// indexKey derives the storage key an ActionID's IndexEntry is kept under.
+func indexKey(actionID [64]byte) [64]byte {
+	return sha512.Sum512(append([]byte(indexNamespace), actionID[:]...))
+}
+
+// getIndex resolves actionID to its IndexEntry, checking each backend in
+// the chain in turn.
+func (c *ArtifactCache) getIndex(actionID [64]byte) (IndexEntry, error) {
+	key := indexKey(actionID)
+
+	var lastErr error
+	for _, b := range c.backends {
+		rc, err := b.Get(key)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var entry IndexEntry
+		err = json.NewDecoder(rc).Decode(&entry)
+		rc.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return entry, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("action not found in cache")
+	}
+	return IndexEntry{}, lastErr
+}
+
+// PutBytes stores the content read from r under its own content-addressed
+// OutputID (the SHA-512 of the bytes) and records actionID -> OutputID in
+// the cache's index. A later Get resolving to the same actionID - or any
+// other actionID whose content happens to hash the same - finds the blob
+// without storing it twice.
+func (c *ArtifactCache) PutBytes(actionID [64]byte, r io.Reader) (OutputID, int64, error) {
+	tmp, err := ioutil.TempFile("", "luet-cache-put-*")
+	if err != nil {
+		return OutputID{}, 0, errors.Wrap(err, "failed creating staging file for cache put")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha512.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return OutputID{}, 0, errors.Wrap(err, "failed staging content for cache put")
+	}
+
+	var outputID OutputID
+	copy(outputID[:], h.Sum(nil))
+
+	for _, b := range c.backends {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return OutputID{}, 0, errors.Wrap(err, "failed rewinding staged content")
+		}
+		if _, _, err := b.Put(outputID, tmp); err != nil {
+			return OutputID{}, 0, errors.Wrapf(err, "failed writing content to cache backend")
+		}
+	}
+
+	entry := IndexEntry{OutputID: outputID, Size: size, Time: time.Now()}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return OutputID{}, 0, errors.Wrap(err, "failed encoding cache index entry")
+	}
+
+	key := indexKey(actionID)
+	for _, b := range c.backends {
+		if _, _, err := b.Put(key, bytes.NewReader(payload)); err != nil {
+			return OutputID{}, 0, errors.Wrap(err, "failed writing cache index entry")
+		}
+	}
+
+	return outputID, size, nil
+}
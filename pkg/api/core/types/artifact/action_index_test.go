@@ -0,0 +1,85 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestActionIndexPutBytesGetIndexRoundTrip(t *testing.T) {
+	c := NewCacheWithBackends(NewMemoryBackend(0))
+	actionID := [64]byte{1}
+
+	outputID, size, err := c.PutBytes(actionID, strings.NewReader("hello cache"))
+	if err != nil {
+		t.Fatalf("PutBytes: %v", err)
+	}
+	if size != int64(len("hello cache")) {
+		t.Fatalf("PutBytes returned size %d, want %d", size, len("hello cache"))
+	}
+
+	entry, err := c.getIndex(actionID)
+	if err != nil {
+		t.Fatalf("getIndex: %v", err)
+	}
+	if entry.OutputID != outputID {
+		t.Fatalf("getIndex returned outputID %x, want %x", entry.OutputID, outputID)
+	}
+	if entry.Size != size {
+		t.Fatalf("getIndex returned size %d, want %d", entry.Size, size)
+	}
+}
+
+func TestActionIndexDedupsIdenticalContentAcrossActionIDs(t *testing.T) {
+	c := NewCacheWithBackends(NewMemoryBackend(0))
+
+	actionA := [64]byte{1}
+	actionB := [64]byte{2}
+
+	outputA, _, err := c.PutBytes(actionA, strings.NewReader("identical content"))
+	if err != nil {
+		t.Fatalf("PutBytes actionA: %v", err)
+	}
+	outputB, _, err := c.PutBytes(actionB, strings.NewReader("identical content"))
+	if err != nil {
+		t.Fatalf("PutBytes actionB: %v", err)
+	}
+
+	if outputA != outputB {
+		t.Fatalf("expected identical content to share an OutputID, got %x and %x", outputA, outputB)
+	}
+
+	entryA, err := c.getIndex(actionA)
+	if err != nil {
+		t.Fatalf("getIndex actionA: %v", err)
+	}
+	entryB, err := c.getIndex(actionB)
+	if err != nil {
+		t.Fatalf("getIndex actionB: %v", err)
+	}
+	if entryA.OutputID != entryB.OutputID {
+		t.Fatalf("expected both ActionIDs to resolve to the same OutputID, got %x and %x", entryA.OutputID, entryB.OutputID)
+	}
+}
+
+func TestActionIndexGetIndexMissingActionID(t *testing.T) {
+	c := NewCacheWithBackends(NewMemoryBackend(0))
+
+	if _, err := c.getIndex([64]byte{9}); err == nil {
+		t.Fatal("expected getIndex to error on an unknown ActionID, got nil")
+	}
+}
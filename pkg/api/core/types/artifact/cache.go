@@ -19,6 +19,8 @@ import (
 	"crypto/sha512"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 
@@ -28,21 +30,103 @@ import (
 // OutputID represents a cache entry identifier (SHA512 hash)
 type OutputID [64]byte
 
-// Cache represents a simple file cache implementation
-type Cache struct {
-	dir string
+// Backend is the storage interface implemented by every cache backend.
+// FSBackend, MemoryBackend, S3Backend and OCIBackend all satisfy it, so
+// ArtifactCache can be pointed at any combination of them.
+type Backend interface {
+	// Get returns a reader for the blob stored under id. The caller must
+	// close it. A missing entry is reported as an error.
+	Get(id [64]byte) (io.ReadCloser, error)
+	// Put stores the content read from r under id.
+	Put(id [64]byte, r io.Reader) (OutputID, int64, error)
+	// Stat reports the size of the entry stored under id, if any.
+	Stat(id [64]byte) (int64, bool, error)
+	// Delete removes the entry stored under id, if any.
+	Delete(id [64]byte) error
 }
 
-// ArtifactCache wraps the Cache for artifact-specific operations
+// localPather is implemented by backends that are themselves backed by the
+// local filesystem, so they can hand back a path instead of a stream and
+// let callers hardlink/mmap the cached file directly instead of copying it.
+// The returned release func pins the entry against concurrent
+// eviction until called, and must always be called once the caller is
+// done with the path.
+type localPather interface {
+	Path(id [64]byte) (path string, release func(), found bool, err error)
+}
+
+// Cache is the interface satisfied by anything that can retrieve and store
+// PackageArtifacts by content. ArtifactCache and ProgCache both implement
+// it.
+type Cache interface {
+	// Get returns the local path to a's cached content along with a
+	// release func the caller must call once done with the path, so a
+	// background eviction can never remove the file out from under a
+	// caller that resolved the path but hasn't opened it yet.
+	Get(a *PackageArtifact) (path string, release func(), err error)
+	Put(a *PackageArtifact) (OutputID, int64, error)
+}
+
+// ArtifactCache retrieves and stores PackageArtifacts across an ordered
+// chain of Backends, e.g. an in-memory tier, a local FSBackend and a shared
+// remote backend. Get checks each backend in order and, on a hit further
+// down the chain, populates the faster backends ahead of it so the next
+// lookup is served locally. Put writes through to every backend in the
+// chain.
 type ArtifactCache struct {
-	Cache
+	backends []Backend
+	verify   bool
+}
+
+// CacheOption configures an ArtifactCache constructed via NewCache or
+// NewCacheWithPolicy.
+type CacheOption func(*ArtifactCache)
+
+// WithVerify enables Verify mode: Get re-hashes an entry's content against
+// the checksums recorded at Put time and treats a mismatch as a miss,
+// deleting the corrupt entry so it gets re-downloaded or rebuilt.
+// GODEBUG=luetverifycache=1 forces this on regardless, mirroring Go's
+// goverifycache.
+func WithVerify(v bool) CacheOption {
+	return func(c *ArtifactCache) { c.verify = v }
+}
+
+// NewCache returns an ArtifactCache backed by a single FSBackend rooted at
+// dir, matching the cache luet has always used on disk.
+func NewCache(dir string, opts ...CacheOption) *ArtifactCache {
+	return newCacheWithOptions([]Backend{NewFSBackend(dir)}, opts)
+}
+
+// NewCacheWithPolicy returns an ArtifactCache backed by a single FSBackend
+// rooted at dir that enforces the given CachePolicy.
+func NewCacheWithPolicy(dir string, policy CachePolicy, opts ...CacheOption) *ArtifactCache {
+	return newCacheWithOptions([]Backend{NewFSBackendWithPolicy(dir, policy)}, opts)
+}
+
+func newCacheWithOptions(backends []Backend, opts []CacheOption) *ArtifactCache {
+	c := &ArtifactCache{backends: backends}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if verifyForced() {
+		c.verify = true
+	}
+	return c
 }
 
-func NewCache(dir string) *ArtifactCache {
-	return &ArtifactCache{Cache: Cache{dir: dir}}
+// NewCacheWithBackends returns an ArtifactCache backed by the given chain
+// of backends, checked in order on Get and written through to on Put.
+func NewCacheWithBackends(backends ...Backend) *ArtifactCache {
+	return &ArtifactCache{backends: backends}
 }
 
-func (c *ArtifactCache) cacheID(a *PackageArtifact) [64]byte {
+// actionID computes a's ActionID: the cache key derived from its build
+// fingerprint and checksums, as opposed to the OutputID its content ends up
+// stored under. Shared by ArtifactCache and ProgCache. Without a
+// CompileSpec, a.Path's basename is used instead of the full path, since
+// a.Path is typically a scratch/build-relative location that differs run
+// to run even for byte-identical content.
+func actionID(a *PackageArtifact) [64]byte {
 	fingerprint := filepath.Base(a.Path)
 	if a.CompileSpec != nil && a.CompileSpec.Package != nil {
 		fingerprint = a.CompileSpec.Package.GetFingerPrint()
@@ -57,53 +141,164 @@ func (c *ArtifactCache) cacheID(a *PackageArtifact) [64]byte {
 	return sha512.Sum512([]byte(fingerprint))
 }
 
-// GetFile retrieves a file from the cache by its ID
-func (c *Cache) GetFile(id [64]byte) (string, bool, error) {
-	// Convert the hash to a hex string for the filename
-	filename := fmt.Sprintf("%x", id)
-	filepath := filepath.Join(c.dir, filename)
+// Get returns the local path to a's cached content, along with a release
+// func the caller must call once done with the path. The ActionID derived
+// from a is first resolved to a content-addressed OutputID via the cache's
+// index (see action_index.go), then that OutputID is looked up in each
+// backend in turn. On a hit in a backend past the first, the faster
+// backends are populated before returning. In Verify mode, a hit is
+// re-hashed against the checksums recorded at Put time; a mismatch evicts
+// the corrupt entry and is treated as a miss in that backend.
+func (c *ArtifactCache) Get(a *PackageArtifact) (string, func(), error) {
+	entry, err := c.getIndex(actionID(a))
+	if err != nil {
+		return "", nil, err
+	}
+
+	verify := c.verify || verifyForced()
+
+	for i, b := range c.backends {
+		if size, found, err := b.Stat(entry.OutputID); err != nil || !found || size != entry.Size {
+			continue
+		}
 
-	if _, err := os.Stat(filepath); os.IsNotExist(err) {
-		return "", false, errors.New("file not found in cache")
+		if verify {
+			if err := c.verifyEntry(b, entry.OutputID); err != nil {
+				log.Printf("cache: corrupt entry outputID=%x backend=%d reason=%q; evicting", entry.OutputID, i, err)
+				b.Delete(entry.OutputID)
+				continue
+			}
+		}
+
+		path, release, err := c.readFrom(b, entry.OutputID)
+		if err != nil {
+			continue
+		}
+		c.populateAhead(entry.OutputID, i)
+		return path, release, nil
 	}
 
-	return filepath, true, nil
+	return "", nil, errors.New("file not found in cache")
 }
 
-// Put stores a file in the cache
-func (c *Cache) Put(id [64]byte, reader io.Reader) (OutputID, int64, error) {
-	if err := os.MkdirAll(c.dir, 0755); err != nil {
-		return OutputID{}, 0, errors.Wrapf(err, "failed to create cache directory %s", c.dir)
+// verifyEntry re-hashes the content stored under id in b against the
+// EntryMeta recorded at Put time, if b supports persisting one. A backend
+// with no metadata for id (or that doesn't implement metaStore at all) is
+// treated as verified, since there's nothing to check it against.
+func (c *ArtifactCache) verifyEntry(b Backend, id [64]byte) error {
+	ms, ok := b.(metaStore)
+	if !ok {
+		return nil
+	}
+
+	meta, found, err := ms.GetMeta(id)
+	if err != nil || !found {
+		return nil
+	}
+
+	rc, err := b.Get(id)
+	if err != nil {
+		return err
 	}
+	defer rc.Close()
+
+	return verifyChecksums(rc, meta.Checksums)
+}
 
-	filename := fmt.Sprintf("%x", id)
-	filepath := filepath.Join(c.dir, filename)
+// readFrom resolves id in b to a local path and a release func the caller
+// must call once done with it. Backends that are themselves local
+// (localPather) hand back their own path pinned against eviction; every
+// other backend is copied into a private temp file instead, whose release
+// func removes it.
+func (c *ArtifactCache) readFrom(b Backend, id [64]byte) (string, func(), error) {
+	if lp, ok := b.(localPather); ok {
+		path, release, found, err := lp.Path(id)
+		if err != nil {
+			return "", nil, err
+		}
+		if !found {
+			return "", nil, errors.New("file not found in cache")
+		}
+		return path, release, nil
+	}
 
-	outFile, err := os.Create(filepath)
+	rc, err := b.Get(id)
 	if err != nil {
-		return OutputID{}, 0, errors.Wrapf(err, "failed to create cache file %s", filepath)
+		return "", nil, err
 	}
-	defer outFile.Close()
+	defer rc.Close()
 
-	written, err := io.Copy(outFile, reader)
+	tmp, err := ioutil.TempFile("", fmt.Sprintf("%x-*", id))
 	if err != nil {
-		os.Remove(filepath)
-		return OutputID{}, 0, errors.Wrapf(err, "failed to copy content to cache file %s", filepath)
+		return "", nil, err
 	}
+	defer tmp.Close()
 
-	return OutputID(id), written, nil
+	if _, err := io.Copy(tmp, rc); err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
 }
 
-func (c *ArtifactCache) Get(a *PackageArtifact) (string, error) {
-	fileName, _, err := c.Cache.GetFile(c.cacheID(a))
-	return fileName, err
+// populateAhead best-effort copies the entry for id into every backend
+// before index hit, since those are assumed to be the faster/closer tiers.
+func (c *ArtifactCache) populateAhead(id [64]byte, hit int) {
+	for i := 0; i < hit; i++ {
+		rc, err := c.backends[hit].Get(id)
+		if err != nil {
+			continue
+		}
+		c.backends[i].Put(id, rc)
+		rc.Close()
+	}
 }
 
+// Put stores a's content under a content-addressed OutputID and records the
+// ActionID derived from a in the cache's index, so two PackageArtifacts
+// built from different specs that happen to produce byte-identical output
+// end up sharing a single stored blob. See PutBytes in action_index.go. On
+// any backend that supports it, a's checksums are also recorded as an
+// EntryMeta sidecar for later Verify/Fsck use.
 func (c *ArtifactCache) Put(a *PackageArtifact) (OutputID, int64, error) {
 	file, err := os.Open(a.Path)
 	if err != nil {
 		return OutputID{}, 0, errors.Wrapf(err, "failed opening %s", a.Path)
 	}
 	defer file.Close()
-	return c.Cache.Put(c.cacheID(a), file)
+
+	outputID, size, err := c.PutBytes(actionID(a), file)
+	if err != nil {
+		return OutputID{}, 0, err
+	}
+
+	if err := c.putMeta(outputID, size, a); err != nil {
+		return OutputID{}, 0, err
+	}
+
+	return outputID, size, nil
+}
+
+func (c *ArtifactCache) putMeta(outputID OutputID, size int64, a *PackageArtifact) error {
+	if len(a.Checksums) == 0 {
+		return nil
+	}
+
+	checksums := make(map[string]string, len(a.Checksums))
+	for _, cs := range a.Checksums.List() {
+		checksums[cs[0]] = cs[1]
+	}
+	meta := EntryMeta{Size: size, Checksums: checksums}
+
+	for _, b := range c.backends {
+		ms, ok := b.(metaStore)
+		if !ok {
+			continue
+		}
+		if err := ms.PutMeta(outputID, meta); err != nil {
+			return errors.Wrap(err, "failed writing cache entry metadata")
+		}
+	}
+
+	return nil
 }
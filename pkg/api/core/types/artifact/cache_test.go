@@ -0,0 +1,145 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestArtifact(t *testing.T, dir, content string) *PackageArtifact {
+	t.Helper()
+	path := filepath.Join(dir, "artifact.bin")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &PackageArtifact{Path: path}
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestArtifactCacheGetVerifyModeEvictsCorruptEntry(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "artifact-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	cacheDir, err := ioutil.TempDir("", "artifact-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	content := "trustworthy package content"
+	a := writeTestArtifact(t, srcDir, content)
+
+	cache := NewCacheWithPolicy(cacheDir, CachePolicy{}, WithVerify(true))
+	backend := cache.backends[0].(*FSBackend)
+
+	outputID, size, err := cache.Put(a)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// Put(a) only records EntryMeta when a.Checksums is set, which this
+	// snapshot's PackageArtifact doesn't exercise here; record it directly
+	// so Get's Verify mode has something to check the corrupted bytes below
+	// against.
+	if err := backend.PutMeta(outputID, EntryMeta{Size: size, Checksums: map[string]string{"sha256": sha256Hex(content)}}); err != nil {
+		t.Fatalf("PutMeta: %v", err)
+	}
+
+	// Corrupt the stored content in place, keeping its size so the Stat
+	// check that gates Verify still lets it through.
+	corruptPath := backend.path([64]byte(outputID))
+	if err := ioutil.WriteFile(corruptPath, []byte("TRUSTWORTHY package content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := cache.Get(a); err == nil {
+		t.Fatal("expected Get to report a miss for a corrupted entry, got nil error")
+	}
+
+	if _, found, err := backend.Stat([64]byte(outputID)); err != nil || found {
+		t.Fatalf("expected corrupt entry to be evicted, found=%v err=%v", found, err)
+	}
+}
+
+func TestArtifactCacheFsckReportsAndSkipsCleanEntries(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "artifact-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	cacheDir, err := ioutil.TempDir("", "artifact-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	cache := NewCacheWithPolicy(cacheDir, CachePolicy{})
+	backend := cache.backends[0].(*FSBackend)
+
+	cleanContent := "untouched package content"
+	clean := writeTestArtifact(t, srcDir, cleanContent)
+	cleanOutputID, cleanSize, err := cache.Put(clean)
+	if err != nil {
+		t.Fatalf("Put clean: %v", err)
+	}
+	if err := backend.PutMeta(cleanOutputID, EntryMeta{Size: cleanSize, Checksums: map[string]string{"sha256": sha256Hex(cleanContent)}}); err != nil {
+		t.Fatalf("PutMeta clean: %v", err)
+	}
+
+	corruptSrcDir, err := ioutil.TempDir("", "artifact-src-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(corruptSrcDir)
+
+	corruptContent := "package content to corrupt"
+	corrupt := writeTestArtifact(t, corruptSrcDir, corruptContent)
+	corruptOutputID, corruptSize, err := cache.Put(corrupt)
+	if err != nil {
+		t.Fatalf("Put corrupt: %v", err)
+	}
+	if err := backend.PutMeta(corruptOutputID, EntryMeta{Size: corruptSize, Checksums: map[string]string{"sha256": sha256Hex(corruptContent)}}); err != nil {
+		t.Fatalf("PutMeta corrupt: %v", err)
+	}
+	if err := ioutil.WriteFile(backend.path([64]byte(corruptOutputID)), []byte("PACKAGE content to corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	corruptions, err := cache.Fsck(context.Background())
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+
+	if len(corruptions) != 1 {
+		t.Fatalf("expected exactly one corruption, got %d: %+v", len(corruptions), corruptions)
+	}
+	if corruptions[0].ID != hex.EncodeToString(corruptOutputID[:]) {
+		t.Fatalf("corruption reported for id %q, want %q", corruptions[0].ID, hex.EncodeToString(corruptOutputID[:]))
+	}
+}
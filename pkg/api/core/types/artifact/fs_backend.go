@@ -0,0 +1,556 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+// accessSuffix is appended to a cache entry's hex name to get the path of
+// its access-time sidecar file. The sidecar's mtime is bumped on every
+// Get/Path so Trim can make LRU decisions without disturbing the mtime of
+// the cached content itself.
+const accessSuffix = "-a"
+
+// tmpSuffix is used for the staging file that Put writes to before it is
+// renamed into place, so a reader never observes a partially written entry.
+const tmpSuffix = ".tmp"
+
+// trimMarker records the time of the last Trim, so that multiple luet
+// processes sharing a cache dir don't all trim back to back.
+const trimMarker = "trim.txt"
+
+// lockSuffix is appended to a cache entry's hex name to get the path of the
+// sentinel file Put and Path take an exclusive lock on.
+const lockSuffix = ".lock"
+
+// metaSuffix is appended to a cache entry's hex name to get the path of its
+// EntryMeta sidecar, used by Verify and Fsck.
+const metaSuffix = ".meta"
+
+// CachePolicy configures size- and age-based eviction for an FSBackend.
+type CachePolicy struct {
+	// MaxBytes is the total size budget for the cache directory. Zero means
+	// no size-based eviction.
+	MaxBytes int64
+	// MaxAge evicts entries that haven't been accessed in this long. Zero
+	// means no age-based eviction.
+	MaxAge time.Duration
+	// TrimInterval is how often the background goroutine started by
+	// NewFSBackendWithPolicy runs Trim. Zero disables the background
+	// goroutine.
+	TrimInterval time.Duration
+}
+
+// FSBackend stores cache entries as plain files in a directory. It is the
+// backend luet has always used for its local on-disk cache.
+type FSBackend struct {
+	dir    string
+	policy *CachePolicy
+
+	pinMu sync.Mutex
+	pins  map[[64]byte]int
+}
+
+// NewFSBackend returns an FSBackend rooted at dir with no eviction policy.
+func NewFSBackend(dir string) *FSBackend {
+	return &FSBackend{dir: dir, pins: map[[64]byte]int{}}
+}
+
+// NewFSBackendWithPolicy returns an FSBackend rooted at dir that enforces
+// policy. If policy.TrimInterval is non-zero, a background goroutine is
+// started that periodically calls Trim for the lifetime of the process.
+func NewFSBackendWithPolicy(dir string, policy CachePolicy) *FSBackend {
+	b := &FSBackend{dir: dir, policy: &policy, pins: map[[64]byte]int{}}
+	if policy.TrimInterval > 0 {
+		go b.trimLoop(policy.TrimInterval)
+	}
+	return b
+}
+
+func (b *FSBackend) trimLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Best effort: a failed trim just means we try again next tick.
+		_ = b.Trim()
+	}
+}
+
+func (b *FSBackend) path(id [64]byte) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%x", id))
+}
+
+// touchAccess updates (creating if necessary) the access-time sidecar for
+// id, used by Trim to find the least-recently-used entries.
+func (b *FSBackend) touchAccess(id [64]byte) error {
+	accessPath := b.path(id) + accessSuffix
+	now := time.Now()
+	if _, err := os.Stat(accessPath); os.IsNotExist(err) {
+		f, err := os.Create(accessPath)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	return os.Chtimes(accessPath, now, now)
+}
+
+// lockPath returns the sentinel file Put and Path take an exclusive lock on
+// around the rename into and read of id's entry, so a reader blocks until
+// an in-progress write finishes instead of racing an incomplete rename.
+func (b *FSBackend) lockPath(id [64]byte) string {
+	return b.path(id) + lockSuffix
+}
+
+// pin marks id as in use, so Trim and Delete leave it alone until every
+// matching unpin call has run.
+func (b *FSBackend) pin(id [64]byte) {
+	b.pinMu.Lock()
+	b.pins[id]++
+	b.pinMu.Unlock()
+}
+
+func (b *FSBackend) unpin(id [64]byte) {
+	b.pinMu.Lock()
+	if n := b.pins[id]; n <= 1 {
+		delete(b.pins, id)
+	} else {
+		b.pins[id] = n - 1
+	}
+	b.pinMu.Unlock()
+}
+
+func (b *FSBackend) isPinned(id [64]byte) bool {
+	b.pinMu.Lock()
+	defer b.pinMu.Unlock()
+	return b.pins[id] > 0
+}
+
+// Path returns the on-disk path of the entry stored under id, without
+// copying it, so callers can hardlink/mmap it directly, along with a
+// release func the caller must call once it's done with the path. Until
+// release is called, the entry is pinned: Trim and Delete leave it alone
+// instead of racing a caller that resolved the path but hasn't opened it
+// yet.
+func (b *FSBackend) Path(id [64]byte) (string, func(), bool, error) {
+	unlock, err := lockedfile.MutexAt(b.lockPath(id)).Lock()
+	if err != nil {
+		return "", nil, false, errors.Wrap(err, "failed locking cache entry")
+	}
+	defer unlock()
+
+	p := b.path(id)
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return "", nil, false, nil
+	} else if err != nil {
+		return "", nil, false, err
+	}
+
+	if err := b.touchAccess(id); err != nil {
+		return "", nil, false, errors.Wrap(err, "failed updating cache access time")
+	}
+
+	b.pin(id)
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			b.unpin(id)
+		}
+	}
+	return p, release, true, nil
+}
+
+// Get opens the entry stored under id for reading. The returned
+// ReadCloser pins the entry against Trim/Delete until it is closed, so a
+// background eviction can never turn an in-flight Get into a spurious
+// "file not found".
+func (b *FSBackend) Get(id [64]byte) (io.ReadCloser, error) {
+	p, release, found, err := b.Path(id)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("file not found in cache")
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &pinnedFile{File: f, release: release}, nil
+}
+
+// pinnedFile wraps an *os.File opened from the cache directory so the
+// entry it was opened from stays pinned for as long as the file is open.
+type pinnedFile struct {
+	*os.File
+	release func()
+}
+
+func (f *pinnedFile) Close() error {
+	err := f.File.Close()
+	f.release()
+	return err
+}
+
+// randHex returns n random bytes hex-encoded, used to keep concurrent
+// writers' staging files from colliding.
+func randHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		// A predictable fallback just means two unlucky concurrent writers
+		// that draw the same name have one Put fail with EEXIST instead of
+		// both writing to one staging file.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return fmt.Sprintf("%x", buf)
+}
+
+// Put stores the content read from r under id. The content is first
+// written to a staging file unique to this process and call, fsync'd, and
+// then renamed into place under a lock shared with Path, so a concurrent
+// reader blocks until the write finishes rather than observing a partial
+// or missing entry.
+func (b *FSBackend) Put(id [64]byte, r io.Reader) (OutputID, int64, error) {
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return OutputID{}, 0, errors.Wrapf(err, "failed to create cache directory %s", b.dir)
+	}
+
+	finalPath := b.path(id)
+	tmpPath := fmt.Sprintf("%s%s-%d-%s", finalPath, tmpSuffix, os.Getpid(), randHex(8))
+
+	outFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return OutputID{}, 0, errors.Wrapf(err, "failed to create cache tmp file %s", tmpPath)
+	}
+
+	written, err := io.Copy(outFile, r)
+	if err != nil {
+		outFile.Close()
+		os.Remove(tmpPath)
+		return OutputID{}, 0, errors.Wrapf(err, "failed to copy content to cache file %s", tmpPath)
+	}
+
+	if err := outFile.Sync(); err != nil {
+		outFile.Close()
+		os.Remove(tmpPath)
+		return OutputID{}, 0, errors.Wrapf(err, "failed to fsync cache tmp file %s", tmpPath)
+	}
+
+	if err := outFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return OutputID{}, 0, errors.Wrapf(err, "failed to close cache tmp file %s", tmpPath)
+	}
+
+	unlock, err := lockedfile.MutexAt(b.lockPath(id)).Lock()
+	if err != nil {
+		os.Remove(tmpPath)
+		return OutputID{}, 0, errors.Wrap(err, "failed locking cache entry")
+	}
+	defer unlock()
+
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		os.Remove(tmpPath)
+		return OutputID{}, 0, errors.Wrapf(err, "failed to rename cache tmp file into %s", finalPath)
+	}
+
+	if err := b.touchAccess(id); err != nil {
+		return OutputID{}, 0, errors.Wrap(err, "failed updating cache access time")
+	}
+
+	return OutputID(id), written, nil
+}
+
+// Stat reports the size of the entry stored under id, if any.
+func (b *FSBackend) Stat(id [64]byte) (int64, bool, error) {
+	info, err := os.Stat(b.path(id))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return info.Size(), true, nil
+}
+
+// Delete removes the entry stored under id, if any, along with its access,
+// meta and lock sidecars, under the same lock Put and Path take so it
+// can't race a write in progress. An entry currently pinned by an
+// in-flight Get/Path is left alone instead, the same as Trim does.
+func (b *FSBackend) Delete(id [64]byte) error {
+	_, err := b.evict(id, entryInfo{path: b.path(id)})
+	return err
+}
+
+// entryInfo describes one cached blob for the purposes of Trim.
+type entryInfo struct {
+	id       string
+	path     string
+	size     int64
+	accessed time.Time
+}
+
+// Trim scans the cache directory and removes entries until the policy's
+// MaxBytes budget is satisfied, plus any entry whose access time is older
+// than MaxAge. It is safe to call from multiple luet processes sharing dir:
+// a trim.txt marker is used to skip redundant trims run within the same
+// policy's TrimInterval.
+func (b *FSBackend) Trim() error {
+	if b.policy == nil {
+		return nil
+	}
+
+	if b.recentlyTrimmed() {
+		return nil
+	}
+
+	entries, err := b.listEntries()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+
+	now := time.Now()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].accessed.Before(entries[j].accessed) })
+
+	for _, e := range entries {
+		expired := b.policy.MaxAge > 0 && now.Sub(e.accessed) > b.policy.MaxAge
+		overBudget := b.policy.MaxBytes > 0 && total > b.policy.MaxBytes
+		if !expired && !overBudget {
+			continue
+		}
+		id, ok := decodeEntryID(e.id)
+		if !ok {
+			continue
+		}
+		removed, err := b.evict(id, e)
+		if err != nil {
+			return errors.Wrapf(err, "failed evicting cache entry %s", e.id)
+		}
+		if removed {
+			total -= e.size
+		}
+	}
+
+	return b.writeTrimMarker()
+}
+
+func (b *FSBackend) listEntries() ([]entryInfo, error) {
+	files, err := ioutil.ReadDir(b.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading cache directory %s", b.dir)
+	}
+
+	entries := make([]entryInfo, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasSuffix(name, accessSuffix) || strings.HasSuffix(name, lockSuffix) ||
+			strings.HasSuffix(name, metaSuffix) || strings.Contains(name, tmpSuffix) || name == trimMarker {
+			continue
+		}
+
+		accessed := f.ModTime()
+		if accessInfo, err := os.Stat(filepath.Join(b.dir, name+accessSuffix)); err == nil {
+			accessed = accessInfo.ModTime()
+		}
+
+		entries = append(entries, entryInfo{
+			id:       name,
+			path:     filepath.Join(b.dir, name),
+			size:     f.Size(),
+			accessed: accessed,
+		})
+	}
+	return entries, nil
+}
+
+// evict removes e's content file along with its access, meta and lock
+// sidecars, unless id is pinned by an in-flight Get/Path that resolved
+// this entry and hasn't released it yet - in that case it is left alone
+// for the next Trim tick instead, and evict reports removed=false so
+// Trim doesn't count a skipped entry's size against its budget. It
+// takes the same per-entry lock Put and Path do, so the pin check can't
+// race a Path call that's in the middle of pinning the entry: they
+// serialize on the same lock.
+func (b *FSBackend) evict(id [64]byte, e entryInfo) (removed bool, err error) {
+	lockPath := e.path + lockSuffix
+
+	unlock, err := lockedfile.MutexAt(lockPath).Lock()
+	if err != nil {
+		return false, errors.Wrap(err, "failed locking cache entry for eviction")
+	}
+
+	if b.isPinned(id) {
+		unlock()
+		return false, nil
+	}
+
+	err = removeIfExists(e.path, e.path+accessSuffix, e.path+metaSuffix)
+	unlock()
+	if err != nil {
+		return false, err
+	}
+
+	// Removed after unlock: the sentinel no longer guards anything once the
+	// entry it was protecting is gone.
+	os.Remove(lockPath)
+	return true, nil
+}
+
+// decodeEntryID parses the hex-encoded cache filename name back into the
+// [64]byte id it was derived from, reporting false for anything that
+// isn't a well-formed entry name (a sidecar or stray file listEntries
+// didn't already filter out).
+func decodeEntryID(name string) ([64]byte, bool) {
+	var id [64]byte
+	raw, err := hex.DecodeString(name)
+	if err != nil || len(raw) != len(id) {
+		return id, false
+	}
+	copy(id[:], raw)
+	return id, true
+}
+
+func removeIfExists(paths ...string) error {
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *FSBackend) recentlyTrimmed() bool {
+	info, err := os.Stat(filepath.Join(b.dir, trimMarker))
+	if err != nil {
+		return false
+	}
+	return time.Since(info.ModTime()) < b.policy.TrimInterval
+}
+
+func (b *FSBackend) writeTrimMarker() error {
+	markerPath := filepath.Join(b.dir, trimMarker)
+	return ioutil.WriteFile(markerPath, []byte(strconv.FormatInt(time.Now().Unix(), 10)), 0644)
+}
+
+func (b *FSBackend) metaPath(id [64]byte) string {
+	return b.path(id) + metaSuffix
+}
+
+// PutMeta persists meta as the EntryMeta sidecar for id, implementing
+// metaStore.
+func (b *FSBackend) PutMeta(id [64]byte, meta EntryMeta) error {
+	payload, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, "failed encoding cache entry metadata")
+	}
+	return ioutil.WriteFile(b.metaPath(id), payload, 0644)
+}
+
+// GetMeta reads the EntryMeta sidecar for id, if any, implementing
+// metaStore.
+func (b *FSBackend) GetMeta(id [64]byte) (EntryMeta, bool, error) {
+	data, err := ioutil.ReadFile(b.metaPath(id))
+	if os.IsNotExist(err) {
+		return EntryMeta{}, false, nil
+	}
+	if err != nil {
+		return EntryMeta{}, false, err
+	}
+
+	var meta EntryMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return EntryMeta{}, false, errors.Wrap(err, "failed decoding cache entry metadata")
+	}
+	return meta, true, nil
+}
+
+var _ Fscker = (*FSBackend)(nil)
+
+// Fsck walks the whole cache directory and validates every entry that has
+// an EntryMeta sidecar against it, returning one Corruption per entry whose
+// size or checksums don't match.
+func (b *FSBackend) Fsck(ctx context.Context) ([]Corruption, error) {
+	entries, err := b.listEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	var corruptions []Corruption
+	for _, e := range entries {
+		select {
+		case <-ctx.Done():
+			return corruptions, ctx.Err()
+		default:
+		}
+
+		id, ok := decodeEntryID(e.id)
+		if !ok {
+			continue
+		}
+
+		meta, found, err := b.GetMeta(id)
+		if err != nil || !found {
+			continue
+		}
+
+		if err := b.fsckEntry(e, meta); err != nil {
+			corruptions = append(corruptions, Corruption{ID: e.id, Path: e.path, Reason: err.Error()})
+		}
+	}
+
+	return corruptions, nil
+}
+
+func (b *FSBackend) fsckEntry(e entryInfo, meta EntryMeta) error {
+	if e.size != meta.Size {
+		return errors.Errorf("size mismatch: expected %d, got %d", meta.Size, e.size)
+	}
+
+	f, err := os.Open(e.path)
+	if err != nil {
+		return errors.Wrap(err, "failed opening cache entry")
+	}
+	defer f.Close()
+
+	return verifyChecksums(f, meta.Checksums)
+}
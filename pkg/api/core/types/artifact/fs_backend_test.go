@@ -0,0 +1,277 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFSBackendPutGetRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewFSBackend(dir)
+	id := [64]byte{1}
+
+	outputID, size, err := b.Put(id, strings.NewReader("hello cache"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if outputID != OutputID(id) {
+		t.Fatalf("Put returned outputID %x, want %x", outputID, id)
+	}
+	if size != int64(len("hello cache")) {
+		t.Fatalf("Put returned size %d, want %d", size, len("hello cache"))
+	}
+
+	rc, err := b.Get(id)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello cache" {
+		t.Fatalf("Get returned %q, want %q", got, "hello cache")
+	}
+}
+
+func TestFSBackendDeleteRemovesSidecars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewFSBackend(dir)
+	id := [64]byte{2}
+
+	if _, _, err := b.Put(id, strings.NewReader("content")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := b.PutMeta(id, EntryMeta{Size: 7}); err != nil {
+		t.Fatalf("PutMeta: %v", err)
+	}
+	_, release, _, err := b.Path(id)
+	if err != nil {
+		t.Fatalf("Path: %v", err)
+	}
+	release()
+
+	if err := b.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	for _, suffix := range []string{"", accessSuffix, metaSuffix, lockSuffix} {
+		if _, err := os.Stat(b.path(id) + suffix); !os.IsNotExist(err) {
+			t.Fatalf("expected %s%s to be removed, stat error: %v", b.path(id), suffix, err)
+		}
+	}
+
+	if _, found, err := b.Stat(id); err != nil || found {
+		t.Fatalf("Stat after Delete: found=%v err=%v", found, err)
+	}
+}
+
+func TestFSBackendTrimEvictsOverBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewFSBackendWithPolicy(dir, CachePolicy{MaxBytes: 5})
+
+	older := [64]byte{3}
+	newer := [64]byte{4}
+
+	if _, _, err := b.Put(older, strings.NewReader("aaaaa")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// Force a distinct, strictly earlier access time so Trim's LRU ordering
+	// is deterministic regardless of filesystem timestamp resolution.
+	if err := os.Chtimes(b.path(older)+accessSuffix, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Put(newer, strings.NewReader("bbbbb")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if err := b.Trim(); err != nil {
+		t.Fatalf("Trim: %v", err)
+	}
+
+	if _, found, err := b.Stat(older); err != nil || found {
+		t.Fatalf("expected older entry evicted, found=%v err=%v", found, err)
+	}
+	if _, found, err := b.Stat(newer); err != nil || !found {
+		t.Fatalf("expected newer entry kept, found=%v err=%v", found, err)
+	}
+}
+
+func TestFSBackendTrimSkipsPinnedEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewFSBackendWithPolicy(dir, CachePolicy{MaxBytes: 5})
+
+	older := [64]byte{6}
+	newer := [64]byte{7}
+
+	if _, _, err := b.Put(older, strings.NewReader("aaaaa")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := os.Chtimes(b.path(older)+accessSuffix, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate an in-flight Get holding the older entry open: resolve its
+	// path but don't release it yet.
+	rc, err := b.Get(older)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if _, _, err := b.Put(newer, strings.NewReader("bbbbb")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if err := b.Trim(); err != nil {
+		t.Fatalf("Trim: %v", err)
+	}
+
+	if _, found, err := b.Stat(older); err != nil || !found {
+		t.Fatalf("expected pinned entry to survive Trim, found=%v err=%v", found, err)
+	}
+
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The first Trim evicted newer in older's place to honor the budget, so
+	// put it back and age older again to push the directory over MaxBytes
+	// with older as the least-recently-used entry.
+	if _, _, err := b.Put(newer, strings.NewReader("bbbbb")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := os.Chtimes(b.path(older)+accessSuffix, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Trim(); err != nil {
+		t.Fatalf("second Trim: %v", err)
+	}
+	if _, found, err := b.Stat(older); err != nil || found {
+		t.Fatalf("expected unpinned entry evicted on next Trim, found=%v err=%v", found, err)
+	}
+}
+
+func TestFSBackendTrimBudgetIgnoresSkippedPinnedEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewFSBackendWithPolicy(dir, CachePolicy{MaxBytes: 5})
+
+	older := [64]byte{8}
+	newer := [64]byte{9}
+
+	if _, _, err := b.Put(older, strings.NewReader("aaaaa")); err != nil {
+		t.Fatalf("Put older: %v", err)
+	}
+	if err := os.Chtimes(b.path(older)+accessSuffix, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pin older via an in-flight Get, the same way TestFSBackendTrimSkipsPinnedEntry
+	// does, so Trim has to skip it.
+	rc, err := b.Get(older)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer rc.Close()
+
+	if _, _, err := b.Put(newer, strings.NewReader("bbbbb")); err != nil {
+		t.Fatalf("Put newer: %v", err)
+	}
+
+	if err := b.Trim(); err != nil {
+		t.Fatalf("Trim: %v", err)
+	}
+
+	// older is pinned and must survive, but its size must not be counted as
+	// freed: newer must still be evicted to bring the directory back under
+	// MaxBytes, even though older was left on disk ahead of it.
+	if _, found, err := b.Stat(older); err != nil || !found {
+		t.Fatalf("expected pinned entry to survive Trim, found=%v err=%v", found, err)
+	}
+	if _, found, err := b.Stat(newer); err != nil || found {
+		t.Fatalf("expected newer entry to be evicted to honor the byte budget, found=%v err=%v", found, err)
+	}
+}
+
+func TestFSBackendConcurrentPutGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewFSBackend(dir)
+	id := [64]byte{5}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := b.Put(id, strings.NewReader("concurrent")); err != nil {
+				t.Errorf("Put: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	rc, err := b.Get(id)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "concurrent" {
+		t.Fatalf("Get returned %q, want %q", got, "concurrent")
+	}
+}
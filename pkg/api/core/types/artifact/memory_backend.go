@@ -0,0 +1,140 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryBackend is a bounded, in-process LRU cache backend, useful for
+// tests and for short-lived CI runs where paying for disk I/O isn't worth
+// it. Entries are evicted oldest-accessed-first once maxBytes is exceeded.
+type MemoryBackend struct {
+	maxBytes int64
+
+	mu       sync.Mutex
+	size     int64
+	order    *list.List
+	elements map[[64]byte]*list.Element
+}
+
+type memoryEntry struct {
+	id   [64]byte
+	data []byte
+}
+
+// NewMemoryBackend returns a MemoryBackend that holds at most maxBytes of
+// content before evicting the least-recently-used entries. A maxBytes of
+// zero means unbounded.
+func NewMemoryBackend(maxBytes int64) *MemoryBackend {
+	return &MemoryBackend{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		elements: map[[64]byte]*list.Element{},
+	}
+}
+
+func (m *MemoryBackend) Get(id [64]byte) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.elements[id]
+	if !ok {
+		return nil, errors.New("file not found in cache")
+	}
+	m.order.MoveToFront(el)
+
+	return ioutil.NopCloser(bytes.NewReader(el.Value.(*memoryEntry).data)), nil
+}
+
+// Put stores the content read from r under id, evicting older entries as
+// needed to stay within maxBytes. Content larger than maxBytes on its own
+// is rejected rather than accepted and immediately evicted, since the
+// latter would make Put report success for an entry Get can never find.
+func (m *MemoryBackend) Put(id [64]byte, r io.Reader) (OutputID, int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return OutputID{}, 0, errors.Wrap(err, "failed reading content for memory cache")
+	}
+
+	if m.maxBytes > 0 && int64(len(data)) > m.maxBytes {
+		return OutputID{}, 0, errors.Errorf("content size %d exceeds memory cache budget %d", len(data), m.maxBytes)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.elements[id]; ok {
+		m.size -= int64(len(el.Value.(*memoryEntry).data))
+		m.order.Remove(el)
+		delete(m.elements, id)
+	}
+
+	el := m.order.PushFront(&memoryEntry{id: id, data: data})
+	m.elements[id] = el
+	m.size += int64(len(data))
+
+	m.evictLocked()
+
+	return OutputID(id), int64(len(data)), nil
+}
+
+func (m *MemoryBackend) evictLocked() {
+	if m.maxBytes <= 0 {
+		return
+	}
+	for m.size > m.maxBytes {
+		oldest := m.order.Back()
+		if oldest == nil {
+			return
+		}
+		entry := oldest.Value.(*memoryEntry)
+		m.size -= int64(len(entry.data))
+		m.order.Remove(oldest)
+		delete(m.elements, entry.id)
+	}
+}
+
+func (m *MemoryBackend) Stat(id [64]byte) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.elements[id]
+	if !ok {
+		return 0, false, nil
+	}
+	return int64(len(el.Value.(*memoryEntry).data)), true, nil
+}
+
+func (m *MemoryBackend) Delete(id [64]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.elements[id]
+	if !ok {
+		return nil
+	}
+	m.size -= int64(len(el.Value.(*memoryEntry).data))
+	m.order.Remove(el)
+	delete(m.elements, id)
+	return nil
+}
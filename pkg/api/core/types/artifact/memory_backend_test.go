@@ -0,0 +1,105 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMemoryBackendPutGetRoundTrip(t *testing.T) {
+	b := NewMemoryBackend(0)
+	id := [64]byte{1}
+
+	if _, _, err := b.Put(id, strings.NewReader("hello")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	rc, err := b.Get(id)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("Get returned %q, want %q", got, "hello")
+	}
+}
+
+func TestMemoryBackendEvictsLeastRecentlyUsed(t *testing.T) {
+	b := NewMemoryBackend(10)
+
+	oldest := [64]byte{1}
+	middle := [64]byte{2}
+	newest := [64]byte{3}
+
+	if _, _, err := b.Put(oldest, strings.NewReader("aaaaa")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, _, err := b.Put(middle, strings.NewReader("bbbbb")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// Touch oldest so it's no longer the least-recently-used entry.
+	if _, err := b.Get(oldest); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if _, _, err := b.Put(newest, strings.NewReader("ccccc")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if _, found, err := b.Stat(middle); err != nil || found {
+		t.Fatalf("expected middle entry evicted, found=%v err=%v", found, err)
+	}
+	if _, found, err := b.Stat(oldest); err != nil || !found {
+		t.Fatalf("expected recently-touched oldest entry kept, found=%v err=%v", found, err)
+	}
+	if _, found, err := b.Stat(newest); err != nil || !found {
+		t.Fatalf("expected newest entry kept, found=%v err=%v", found, err)
+	}
+}
+
+func TestMemoryBackendRejectsEntryLargerThanBudget(t *testing.T) {
+	b := NewMemoryBackend(4)
+	id := [64]byte{1}
+
+	if _, _, err := b.Put(id, strings.NewReader("toolarge")); err == nil {
+		t.Fatal("expected Put to reject an entry larger than maxBytes, got nil error")
+	}
+
+	if _, found, err := b.Stat(id); err != nil || found {
+		t.Fatalf("rejected entry should not be cached, found=%v err=%v", found, err)
+	}
+}
+
+func TestMemoryBackendDelete(t *testing.T) {
+	b := NewMemoryBackend(0)
+	id := [64]byte{1}
+
+	if _, _, err := b.Put(id, strings.NewReader("hello")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := b.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, found, err := b.Stat(id); err != nil || found {
+		t.Fatalf("expected entry gone after Delete, found=%v err=%v", found, err)
+	}
+}
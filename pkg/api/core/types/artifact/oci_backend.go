@@ -0,0 +1,140 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/pkg/errors"
+)
+
+// ociTag turns a cache id into the tag a blob is pushed/pulled under, one
+// tag per entry so a pull only needs to fetch a single layer.
+func ociTag(repo name.Repository, id [64]byte) name.Tag {
+	return repo.Tag(fmt.Sprintf("%x", id))
+}
+
+// OCIBackend stores cache entries as single-layer OCI artifacts in a
+// registry, so a compiled package cached by one builder becomes pullable by
+// every other machine in the fleet that can reach the registry.
+type OCIBackend struct {
+	repo    name.Repository
+	options []remote.Option
+}
+
+// NewOCIBackend returns an OCIBackend that pushes/pulls entries as tags
+// under repo (e.g. "registry.example.com/luet-cache"), using opts for
+// authentication and transport.
+func NewOCIBackend(repo name.Repository, opts ...remote.Option) *OCIBackend {
+	return &OCIBackend{repo: repo, options: opts}
+}
+
+func (o *OCIBackend) Get(id [64]byte) (io.ReadCloser, error) {
+	tag := ociTag(o.repo, id)
+
+	img, err := remote.Image(tag, o.options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed pulling %s", tag)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading layers of %s", tag)
+	}
+	if len(layers) != 1 {
+		return nil, errors.Errorf("expected a single layer for %s, got %d", tag, len(layers))
+	}
+
+	return layers[0].Uncompressed()
+}
+
+func (o *OCIBackend) Put(id [64]byte, r io.Reader) (OutputID, int64, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return OutputID{}, 0, errors.Wrap(err, "failed reading content for OCI cache")
+	}
+
+	layer := static.NewLayer(content, "application/vnd.luet.cache.layer.v1+octet-stream")
+
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		return OutputID{}, 0, errors.Wrap(err, "failed assembling OCI artifact")
+	}
+
+	tag := ociTag(o.repo, id)
+	if err := remote.Write(tag, img, o.options...); err != nil {
+		return OutputID{}, 0, errors.Wrapf(err, "failed pushing %s", tag)
+	}
+
+	return OutputID(id), int64(len(content)), nil
+}
+
+func (o *OCIBackend) Stat(id [64]byte) (int64, bool, error) {
+	tag := ociTag(o.repo, id)
+
+	// remote.Head's descriptor Size is the manifest's size, not the cached
+	// blob's; pull the image and ask its single layer instead, the same way
+	// Get resolves it.
+	img, err := remote.Image(tag, o.options...)
+	if isOCINotFound(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "failed pulling %s", tag)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "failed reading layers of %s", tag)
+	}
+	if len(layers) != 1 {
+		return 0, false, errors.Errorf("expected a single layer for %s, got %d", tag, len(layers))
+	}
+
+	size, err := layers[0].Size()
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "failed reading layer size of %s", tag)
+	}
+
+	return size, true, nil
+}
+
+// isOCINotFound reports whether err is the registry reporting that a tag
+// doesn't exist, as opposed to some other transport failure (auth, network,
+// registry outage), mirroring isNotFound's role for S3Backend.
+func isOCINotFound(err error) bool {
+	var terr *transport.Error
+	return stderrors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
+
+func (o *OCIBackend) Delete(id [64]byte) error {
+	tag := ociTag(o.repo, id)
+
+	if err := remote.Delete(tag, o.options...); err != nil {
+		return errors.Wrapf(err, "failed deleting %s", tag)
+	}
+	return nil
+}
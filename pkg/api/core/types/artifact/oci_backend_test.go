@@ -0,0 +1,116 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+)
+
+func newOCIBackendAgainstFakeRegistry(t *testing.T) *OCIBackend {
+	t.Helper()
+
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+
+	repo, err := name.NewRepository(strings.TrimPrefix(srv.URL, "http://")+"/luet-cache", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewOCIBackend(repo)
+}
+
+func TestOCIBackendPutGetStat(t *testing.T) {
+	b := newOCIBackendAgainstFakeRegistry(t)
+	id := [64]byte{1}
+	content := "hello oci"
+
+	if _, _, err := b.Put(id, strings.NewReader(content)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	size, found, err := b.Stat(id)
+	if err != nil || !found {
+		t.Fatalf("Stat: found=%v err=%v", found, err)
+	}
+	if size != int64(len(content)) {
+		t.Fatalf("Stat returned layer size %d, want %d", size, len(content))
+	}
+
+	rc, err := b.Get(id)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Fatalf("Get returned %q, want %q", got, content)
+	}
+}
+
+func TestOCIBackendStatMissingTagReportsNotFoundWithNoError(t *testing.T) {
+	b := newOCIBackendAgainstFakeRegistry(t)
+
+	if _, found, err := b.Stat([64]byte{3}); err != nil || found {
+		t.Fatalf("expected a tag that was never pushed to report found=false err=nil, got found=%v err=%v", found, err)
+	}
+}
+
+func TestOCIBackendStatPropagatesNonNotFoundErrors(t *testing.T) {
+	// A server that answers every request with 500 surfaces something other
+	// than a not-found response, which Stat must propagate rather than
+	// flatten into a plain cache miss.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := name.NewRepository(strings.TrimPrefix(srv.URL, "http://")+"/luet-cache", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewOCIBackend(repo)
+
+	if _, found, err := b.Stat([64]byte{4}); err == nil || found {
+		t.Fatalf("expected a non-registry host to surface an error, got found=%v err=%v", found, err)
+	}
+}
+
+func TestOCIBackendDelete(t *testing.T) {
+	b := newOCIBackendAgainstFakeRegistry(t)
+	id := [64]byte{2}
+
+	if _, _, err := b.Put(id, strings.NewReader("gone soon")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := b.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, found, err := b.Stat(id); err == nil && found {
+		t.Fatal("expected entry gone after Delete")
+	}
+}
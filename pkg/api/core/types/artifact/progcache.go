@@ -0,0 +1,236 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// cacheProgEnv names the environment variable pointing at the external
+// cache helper binary, mirroring Go 1.21's GOCACHEPROG.
+const cacheProgEnv = "LUET_CACHEPROG"
+
+// progInlineBodyLimit is the largest Put body sent inline (base64-encoded
+// in the request); larger bodies are written to a temp file and referenced
+// by path instead, to avoid the base64 overhead on multi-hundred-MB
+// compiled packages.
+const progInlineBodyLimit = 1 << 20 // 1MiB
+
+// progRequest is one line of the request side of the cacheprog protocol.
+type progRequest struct {
+	ID       int64
+	Command  string // "get", "put", or "close"
+	ActionID []byte `json:",omitempty"`
+	OutputID []byte `json:",omitempty"`
+	BodySize int64  `json:",omitempty"`
+	// Body carries small Put bodies inline; encoding/json base64-encodes
+	// []byte automatically.
+	Body []byte `json:",omitempty"`
+	// BodyFile carries large Put bodies by path instead of inline.
+	BodyFile string `json:",omitempty"`
+}
+
+// progResponse is one line of the response side of the cacheprog protocol.
+type progResponse struct {
+	ID       int64
+	Err      string `json:",omitempty"`
+	Miss     bool   `json:",omitempty"`
+	OutputID []byte `json:",omitempty"`
+	Size     int64  `json:",omitempty"`
+	DiskPath string `json:",omitempty"`
+}
+
+// ProgCache is a Cache backed by an external helper process speaking the
+// line-delimited JSON protocol described above, letting teams plug luet
+// into existing CI cache infrastructure (S3, Bazel remote cache,
+// Buildbarn) without recompiling luet. If the helper process exits or
+// reports an error, ProgCache falls back to fallback for the rest of its
+// lifetime.
+type ProgCache struct {
+	fallback *ArtifactCache
+
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	dec   *json.Decoder
+
+	mu     sync.Mutex
+	nextID int64
+	broken bool
+}
+
+var (
+	_ Cache = (*ArtifactCache)(nil)
+	_ Cache = (*ProgCache)(nil)
+)
+
+// NewProgCache spawns the helper binary named by LUET_CACHEPROG and
+// returns a ProgCache that speaks the cacheprog protocol to it, falling
+// back to fallback if the helper is unreachable or misbehaves.
+func NewProgCache(fallback *ArtifactCache) (*ProgCache, error) {
+	prog := os.Getenv(cacheProgEnv)
+	if prog == "" {
+		return nil, errors.Errorf("%s is not set", cacheProgEnv)
+	}
+
+	cmd := exec.Command(prog)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed opening cacheprog stdin")
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed opening cacheprog stdout")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "failed starting cacheprog %s", prog)
+	}
+
+	return &ProgCache{
+		fallback: fallback,
+		cmd:      cmd,
+		stdin:    stdin,
+		dec:      json.NewDecoder(stdout),
+	}, nil
+}
+
+// Close asks the helper process to shut down and waits for it to exit.
+func (p *ProgCache) Close() error {
+	p.roundTrip(progRequest{Command: "close"})
+	p.stdin.Close()
+	return p.cmd.Wait()
+}
+
+// Get resolves a's ActionID against the helper process, falling back to
+// the local cache on a miss or on any protocol error. The release func is
+// a no-op on a helper hit, since the helper process - not ArtifactCache -
+// owns the lifetime of the path it hands back.
+func (p *ProgCache) Get(a *PackageArtifact) (string, func(), error) {
+	if p.isBroken() {
+		return p.fallback.Get(a)
+	}
+
+	id := actionID(a)
+	resp, err := p.roundTrip(progRequest{Command: "get", ActionID: id[:]})
+	if err != nil {
+		p.markBroken()
+		return p.fallback.Get(a)
+	}
+	if resp.Miss {
+		return p.fallback.Get(a)
+	}
+
+	return resp.DiskPath, func() {}, nil
+}
+
+// Put stores a's content via the helper process, falling back to the local
+// cache on any protocol error.
+func (p *ProgCache) Put(a *PackageArtifact) (OutputID, int64, error) {
+	if p.isBroken() {
+		return p.fallback.Put(a)
+	}
+
+	file, err := os.Open(a.Path)
+	if err != nil {
+		return OutputID{}, 0, errors.Wrapf(err, "failed opening %s", a.Path)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return OutputID{}, 0, errors.Wrapf(err, "failed statting %s", a.Path)
+	}
+
+	id := actionID(a)
+	req := progRequest{Command: "put", ActionID: id[:], BodySize: info.Size()}
+	if info.Size() > progInlineBodyLimit {
+		tmp, err := ioutil.TempFile("", "luet-cacheprog-body-*")
+		if err != nil {
+			return OutputID{}, 0, errors.Wrap(err, "failed creating cacheprog body file")
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, file)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return OutputID{}, 0, errors.Wrapf(err, "failed staging %s for cacheprog", a.Path)
+		}
+		req.BodyFile = tmp.Name()
+	} else {
+		body, err := ioutil.ReadAll(file)
+		if err != nil {
+			return OutputID{}, 0, errors.Wrapf(err, "failed reading %s", a.Path)
+		}
+		req.Body = body
+	}
+
+	resp, err := p.roundTrip(req)
+	if err != nil {
+		p.markBroken()
+		return p.fallback.Put(a)
+	}
+
+	var outputID OutputID
+	copy(outputID[:], resp.OutputID)
+	return outputID, resp.Size, nil
+}
+
+func (p *ProgCache) roundTrip(req progRequest) (*progResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextID++
+	req.ID = p.nextID
+
+	if err := json.NewEncoder(p.stdin).Encode(req); err != nil {
+		return nil, errors.Wrap(err, "failed writing cacheprog request")
+	}
+
+	var resp progResponse
+	if err := p.dec.Decode(&resp); err != nil {
+		return nil, errors.Wrap(err, "failed reading cacheprog response")
+	}
+	if resp.ID != req.ID {
+		return nil, errors.Errorf("cacheprog response id %d does not match request id %d", resp.ID, req.ID)
+	}
+	if resp.Err != "" {
+		return nil, errors.New(resp.Err)
+	}
+
+	return &resp, nil
+}
+
+func (p *ProgCache) isBroken() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.broken
+}
+
+func (p *ProgCache) markBroken() {
+	p.mu.Lock()
+	p.broken = true
+	p.mu.Unlock()
+}
@@ -0,0 +1,157 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestProgCache wires up a ProgCache whose stdin/stdout are in-memory
+// pipes instead of a real LUET_CACHEPROG subprocess, with handle playing
+// the part of the helper process.
+func newTestProgCache(t *testing.T, fallback *ArtifactCache, handle func(progRequest) progResponse) *ProgCache {
+	t.Helper()
+
+	reqR, reqW := io.Pipe()   // p writes requests to reqW; the fake helper reads from reqR
+	respR, respW := io.Pipe() // the fake helper writes responses to respW; p reads from respR
+
+	go func() {
+		dec := json.NewDecoder(reqR)
+		enc := json.NewEncoder(respW)
+		for {
+			var req progRequest
+			if err := dec.Decode(&req); err != nil {
+				return
+			}
+			resp := handle(req)
+			resp.ID = req.ID
+			if err := enc.Encode(resp); err != nil {
+				return
+			}
+		}
+	}()
+
+	t.Cleanup(func() {
+		reqW.Close()
+		respR.Close()
+	})
+
+	return &ProgCache{
+		fallback: fallback,
+		stdin:    reqW,
+		dec:      json.NewDecoder(respR),
+	}
+}
+
+func TestProgCacheGetFallsBackOnMiss(t *testing.T) {
+	fallback := NewCacheWithBackends(NewMemoryBackend(0))
+	a := &PackageArtifact{Path: "doesnotmatter"}
+
+	if _, _, err := fallback.PutBytes(actionID(a), strings.NewReader("fallback content")); err != nil {
+		t.Fatalf("seeding fallback: %v", err)
+	}
+
+	p := newTestProgCache(t, fallback, func(req progRequest) progResponse {
+		return progResponse{Miss: true}
+	})
+
+	path, release, err := p.Get(a)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer release()
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "fallback content" {
+		t.Fatalf("Get returned content %q, want %q", got, "fallback content")
+	}
+}
+
+func TestProgCachePutRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "progcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := "compiled package bytes"
+	path := filepath.Join(dir, "pkg.tar")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wantOutputID := OutputID{9}
+	p := newTestProgCache(t, NewCacheWithBackends(NewMemoryBackend(0)), func(req progRequest) progResponse {
+		if req.Command != "put" {
+			t.Errorf("helper received command %q, want %q", req.Command, "put")
+		}
+		if string(req.Body) != content {
+			t.Errorf("helper received body %q, want %q", req.Body, content)
+		}
+		return progResponse{OutputID: wantOutputID[:], Size: int64(len(content))}
+	})
+
+	outputID, size, err := p.Put(&PackageArtifact{Path: path})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if outputID != wantOutputID {
+		t.Fatalf("Put returned outputID %x, want %x", outputID, wantOutputID)
+	}
+	if size != int64(len(content)) {
+		t.Fatalf("Put returned size %d, want %d", size, len(content))
+	}
+}
+
+func TestProgCacheFallsBackAndStaysBrokenAfterHelperError(t *testing.T) {
+	fallback := NewCacheWithBackends(NewMemoryBackend(0))
+	a := &PackageArtifact{Path: "doesnotmatter"}
+
+	if _, _, err := fallback.PutBytes(actionID(a), strings.NewReader("fallback content")); err != nil {
+		t.Fatalf("seeding fallback: %v", err)
+	}
+
+	calls := 0
+	p := newTestProgCache(t, fallback, func(req progRequest) progResponse {
+		calls++
+		return progResponse{Err: "helper exploded"}
+	})
+
+	if _, _, err := p.Get(a); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !p.isBroken() {
+		t.Fatal("expected ProgCache to be marked broken after a helper error")
+	}
+
+	// A second Get must go straight to the fallback instead of round-tripping
+	// to the already-broken helper again.
+	if _, _, err := p.Get(a); err != nil {
+		t.Fatalf("second Get: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected the helper to be consulted once before going broken, got %d calls", calls)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io"
+
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+)
+
+// s3Client is the subset of the AWS SDK S3 client used by S3Backend,
+// extracted as an interface so tests can inject a fake instead of talking
+// to a real bucket.
+type s3Client interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// S3Backend stores cache entries as objects in an S3-compatible bucket,
+// keyed by their hex-encoded id.
+type S3Backend struct {
+	client s3Client
+	bucket string
+	// sse is the server-side-encryption algorithm to request on Put, e.g.
+	// types.ServerSideEncryptionAes256. Empty disables server-side
+	// encryption.
+	sse types.ServerSideEncryption
+}
+
+// NewS3Backend returns an S3Backend storing objects in bucket via client.
+func NewS3Backend(client s3Client, bucket string) *S3Backend {
+	return &S3Backend{client: client, bucket: bucket}
+}
+
+// NewS3BackendWithSSE returns an S3Backend that requests server-side
+// encryption with the given algorithm on every Put.
+func NewS3BackendWithSSE(client s3Client, bucket string, sse types.ServerSideEncryption) *S3Backend {
+	return &S3Backend{client: client, bucket: bucket, sse: sse}
+}
+
+func (s *S3Backend) key(id [64]byte) string {
+	return fmt.Sprintf("%x", id)
+}
+
+func (s *S3Backend) Get(id [64]byte) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed getting object %s", s.key(id))
+	}
+	return out.Body, nil
+}
+
+func (s *S3Backend) Put(id [64]byte, r io.Reader) (OutputID, int64, error) {
+	counted := &countingReader{r: r}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+		Body:   counted,
+	}
+	if s.sse != "" {
+		input.ServerSideEncryption = s.sse
+	}
+
+	if _, err := s.client.PutObject(context.Background(), input); err != nil {
+		return OutputID{}, 0, errors.Wrapf(err, "failed putting object %s", s.key(id))
+	}
+
+	return OutputID(id), counted.n, nil
+}
+
+func (s *S3Backend) Stat(id [64]byte) (int64, bool, error) {
+	out, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if isNotFound(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "failed heading object %s", s.key(id))
+	}
+	return aws.ToInt64(out.ContentLength), true, nil
+}
+
+func (s *S3Backend) Delete(id [64]byte) error {
+	_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	return errors.Wrapf(err, "failed deleting object %s", s.key(id))
+}
+
+// isNotFound reports whether err is an S3 "not found" style API error
+// (the SDK surfaces these as distinct types per operation).
+func isNotFound(err error) bool {
+	var notFound *types.NotFound
+	var noSuchKey *types.NoSuchKey
+	return stderrors.As(err, &notFound) || stderrors.As(err, &noSuchKey)
+}
+
+// countingReader wraps an io.Reader to track how many bytes have been read
+// through it, since s3.PutObjectInput doesn't report bytes written back.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
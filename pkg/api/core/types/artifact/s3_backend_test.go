@@ -0,0 +1,117 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3Client is an in-memory stand-in for the AWS SDK S3 client, enough of
+// s3Client to exercise S3Backend without talking to a real bucket.
+type fakeS3Client struct {
+	objects map[string][]byte
+}
+
+func newFakeS3Client() *fakeS3Client {
+	return &fakeS3Client{objects: map[string][]byte{}}
+}
+
+func (f *fakeS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(params.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	data, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func (f *fakeS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestS3BackendPutGetStatDelete(t *testing.T) {
+	b := NewS3Backend(newFakeS3Client(), "luet-cache")
+	id := [64]byte{1}
+
+	if _, _, err := b.Put(id, bytes.NewReader([]byte("hello s3"))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	size, found, err := b.Stat(id)
+	if err != nil || !found {
+		t.Fatalf("Stat: found=%v err=%v", found, err)
+	}
+	if size != int64(len("hello s3")) {
+		t.Fatalf("Stat returned size %d, want %d", size, len("hello s3"))
+	}
+
+	rc, err := b.Get(id)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer rc.Close()
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello s3" {
+		t.Fatalf("Get returned %q, want %q", got, "hello s3")
+	}
+
+	if err := b.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, found, err := b.Stat(id); err != nil || found {
+		t.Fatalf("expected entry gone after Delete, found=%v err=%v", found, err)
+	}
+}
+
+func TestS3BackendStatMissing(t *testing.T) {
+	b := NewS3Backend(newFakeS3Client(), "luet-cache")
+
+	_, found, err := b.Stat([64]byte{2})
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if found {
+		t.Fatal("expected found=false for a missing object")
+	}
+}
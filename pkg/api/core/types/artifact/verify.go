@@ -0,0 +1,145 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package artifact
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// verifyGodebug is the GODEBUG setting that forces Verify mode on
+// regardless of what a Cache was constructed with, mirroring Go's
+// goverifycache.
+const verifyGodebug = "luetverifycache=1"
+
+// verifyForced reports whether GODEBUG=luetverifycache=1 is set.
+func verifyForced() bool {
+	for _, setting := range strings.Split(os.Getenv("GODEBUG"), ",") {
+		if strings.TrimSpace(setting) == verifyGodebug {
+			return true
+		}
+	}
+	return false
+}
+
+// EntryMeta is the sidecar metadata PutMeta persists for a cache entry at
+// Put time: the expected size and the per-algorithm checksums copied from
+// the PackageArtifact.Checksums that produced it. Get's Verify mode and
+// Fsck both check entries against it.
+type EntryMeta struct {
+	Size      int64
+	Checksums map[string]string
+}
+
+// metaStore is implemented by backends that can persist EntryMeta
+// alongside a blob. Not every Backend needs to: if none in the chain
+// implement it, Verify has nothing to check against and is skipped.
+type metaStore interface {
+	PutMeta(id [64]byte, meta EntryMeta) error
+	GetMeta(id [64]byte) (EntryMeta, bool, error)
+}
+
+// Corruption describes one cache entry that failed verification, with
+// enough information for repair tooling to find and remove it.
+type Corruption struct {
+	ID     string
+	Path   string
+	Reason string
+}
+
+// Fscker is implemented by backends that can run a repair scan over their
+// own storage, such as FSBackend. Not every Backend needs to: a chain with
+// none is simply a no-op Fsck.
+type Fscker interface {
+	Fsck(ctx context.Context) ([]Corruption, error)
+}
+
+// Fsck runs a repair scan over every backend in the chain that implements
+// Fscker, the same object the rest of ArtifactCache's API is used through,
+// so callers don't need to separately reconstruct a standalone backend
+// pointed at the same storage just to check it for corruption.
+func (c *ArtifactCache) Fsck(ctx context.Context) ([]Corruption, error) {
+	var corruptions []Corruption
+	for _, b := range c.backends {
+		fs, ok := b.(Fscker)
+		if !ok {
+			continue
+		}
+		found, err := fs.Fsck(ctx)
+		corruptions = append(corruptions, found...)
+		if err != nil {
+			return corruptions, err
+		}
+	}
+	return corruptions, nil
+}
+
+func newHasher(algo string) (hash.Hash, bool) {
+	switch strings.ToLower(algo) {
+	case "md5":
+		return md5.New(), true
+	case "sha1":
+		return sha1.New(), true
+	case "sha256":
+		return sha256.New(), true
+	case "sha512":
+		return sha512.New(), true
+	default:
+		return nil, false
+	}
+}
+
+// verifyChecksums re-hashes r with every algorithm in want that it
+// recognizes and reports an error on the first mismatch.
+func verifyChecksums(r io.Reader, want map[string]string) error {
+	hashers := make(map[string]hash.Hash, len(want))
+	writers := make([]io.Writer, 0, len(want))
+	for algo := range want {
+		h, ok := newHasher(algo)
+		if !ok {
+			continue
+		}
+		hashers[algo] = h
+		writers = append(writers, h)
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return errors.Wrap(err, "failed hashing cache entry")
+	}
+
+	for algo, expected := range want {
+		h, ok := hashers[algo]
+		if !ok {
+			continue
+		}
+		got := hex.EncodeToString(h.Sum(nil))
+		if got != expected {
+			return errors.Errorf("%s checksum mismatch: expected %s, got %s", algo, expected, got)
+		}
+	}
+
+	return nil
+}